@@ -0,0 +1,438 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connection
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+)
+
+const (
+	// connectionLoggingInterval governs how often connection errors are
+	// logged while the driver is unreachable, so a restarting driver does
+	// not flood the attacher's logs.
+	connectionLoggingInterval = 10 * time.Second
+
+	// defaultProbeInterval is how often Probe() is polled while waiting
+	// for a driver to become ready.
+	defaultProbeInterval = 1 * time.Second
+)
+
+var csiVersion = csi.Version{
+	Major: 0,
+	Minor: 1,
+	Patch: 0,
+}
+
+// PluginCapabilitySet is indexed by the CSI plugin capability type and
+// records which of them the driver has advertised.
+type PluginCapabilitySet map[csi.PluginCapability_Service_Type]bool
+
+// CSIConnection is the interface that the rest of the attacher uses to
+// talk to a CSI driver over gRPC.
+type CSIConnection interface {
+	// GetDriverName returns the name of the CSI driver, as reported by
+	// GetPluginInfo.
+	GetDriverName(ctx context.Context) (string, error)
+
+	// SupportsControllerPublish returns true if the CSI driver supports
+	// the ControllerPublishVolume/ControllerUnpublishVolume RPCs.
+	SupportsControllerPublish(ctx context.Context) (bool, error)
+
+	// GetPluginCapabilities returns the set of plugin capabilities
+	// reported by the driver.
+	GetPluginCapabilities(ctx context.Context) (PluginCapabilitySet, error)
+
+	// Probe calls the identity service's Probe RPC once and returns
+	// whether the driver reported itself ready.
+	Probe(ctx context.Context) (bool, error)
+
+	// Attach calls ControllerPublishVolume to attach a volume to a node.
+	// It returns the publish info returned by the driver, whether the
+	// volume should be considered detached as a result of a failed,
+	// non-retryable call, and an error.
+	Attach(ctx context.Context, volumeID string, readOnly bool, nodeID string, caps *csi.VolumeCapability) (map[string]string, bool, error)
+
+	// Detach calls ControllerUnpublishVolume to detach a volume from a
+	// node. It returns whether the volume should be considered detached,
+	// and an error.
+	Detach(ctx context.Context, volumeID string, nodeID string) (bool, error)
+
+	// SupportsControllerExpand returns true if the CSI driver supports
+	// the ControllerExpandVolume RPC.
+	SupportsControllerExpand(ctx context.Context) (bool, error)
+
+	// Expand calls ControllerExpandVolume to resize a volume to newSize
+	// bytes. It returns the new size reported by the driver and whether
+	// node-side expansion (NodeExpandVolume) is still required.
+	Expand(ctx context.Context, volumeID string, newSize int64, secrets map[string]string, capability *csi.VolumeCapability) (int64, bool, error)
+
+	// Close the connection.
+	Close() error
+}
+
+type csiConnection struct {
+	// conn is used for identity RPCs (GetPluginInfo, GetPluginCapabilities, Probe).
+	conn *grpc.ClientConn
+	// controllerConn is used for controller RPCs (ControllerPublishVolume,
+	// ControllerUnpublishVolume, ControllerGetCapabilities, ControllerExpandVolume).
+	// It is the same connection as conn unless NewSplit was used to dial a
+	// dedicated controller-only endpoint.
+	controllerConn *grpc.ClientConn
+
+	probeInterval time.Duration
+	waitForReady  bool
+
+	capMutex              sync.Mutex
+	pluginCapabilities    PluginCapabilitySet
+	controllerPublishOnce sync.Once
+	controllerPublish     bool
+	controllerPublishErr  error
+
+	driverNameOnce sync.Once
+	driverName     string
+	driverNameErr  error
+
+	controllerExpandOnce sync.Once
+	controllerExpand     bool
+	controllerExpandErr  error
+
+	retryPolicy RetryPolicy
+}
+
+// Option configures a csiConnection created by New.
+type Option func(*csiConnection)
+
+// WithProbeInterval sets the interval at which Probe() is polled while
+// waiting for the driver to become ready. The default is one second.
+func WithProbeInterval(interval time.Duration) Option {
+	return func(c *csiConnection) {
+		c.probeInterval = interval
+	}
+}
+
+// WithWaitForReady makes New block, retrying the Probe RPC at
+// probeInterval with connectionLoggingInterval-throttled logging, until
+// the driver reports it is ready.
+func WithWaitForReady() Option {
+	return func(c *csiConnection) {
+		c.waitForReady = true
+	}
+}
+
+// WithRetryPolicy overrides the RetryPolicy used by Attach, Detach and
+// Expand. The default is DefaultRetryPolicy().
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(c *csiConnection) {
+		c.retryPolicy = policy
+	}
+}
+
+// New creates a connection to a CSI driver listening on the given
+// address and returns a CSIConnection using it for both identity and
+// controller RPCs.
+func New(address string, timeout int, options ...Option) (CSIConnection, error) {
+	return NewSplit(address, address, timeout, options...)
+}
+
+// NewSplit creates a connection to a CSI driver that exposes its
+// controller service on a different endpoint than its identity service,
+// e.g. when the controller runs on a dedicated socket separate from the
+// node plugin. If controllerAddress and identityAddress are equal, a
+// single gRPC connection is shared between both. It returns a
+// CSIConnection routing ControllerPublishVolume/ControllerUnpublishVolume/
+// ControllerGetCapabilities/ControllerExpandVolume over the controller
+// connection, and identity RPCs over the identity connection.
+func NewSplit(controllerAddress, identityAddress string, timeout int, options ...Option) (CSIConnection, error) {
+	identityConn, err := dial(identityAddress, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	controllerConn := identityConn
+	if controllerAddress != identityAddress {
+		controllerConn, err = dial(controllerAddress, timeout)
+		if err != nil {
+			identityConn.Close()
+			return nil, err
+		}
+	}
+
+	csiConn := &csiConnection{
+		conn:           identityConn,
+		controllerConn: controllerConn,
+		probeInterval:  defaultProbeInterval,
+		retryPolicy:    DefaultRetryPolicy(),
+	}
+	for _, option := range options {
+		option(csiConn)
+	}
+
+	if csiConn.waitForReady {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if err := csiConn.waitForDriverReady(ctx); err != nil {
+			csiConn.Close()
+			return nil, err
+		}
+	}
+
+	return csiConn, nil
+}
+
+func dial(address string, timeout int) (*grpc.ClientConn, error) {
+	dialOptions := []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithTimeout(time.Duration(timeout) * time.Second),
+		grpc.WithDialer(func(target string, timeout time.Duration) (net.Conn, error) {
+			return net.Dial("unix", target)
+		}),
+		grpc.WithUnaryInterceptor(logGRPC),
+	}
+	return grpc.Dial(address, dialOptions...)
+}
+
+// waitForDriverReady polls Probe() at probeInterval until the driver
+// reports ready, logging connection errors at most once per
+// connectionLoggingInterval so a restarting driver doesn't spam the log.
+func (c *csiConnection) waitForDriverReady(ctx context.Context) error {
+	var lastLog time.Time
+	for {
+		ready, err := c.Probe(ctx)
+		if err == nil && ready {
+			return nil
+		}
+		if err != nil && time.Since(lastLog) > connectionLoggingInterval {
+			glog.Warningf("still trying to probe CSI driver: %v", err)
+			lastLog = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.probeInterval):
+		}
+	}
+}
+
+func (c *csiConnection) Probe(ctx context.Context) (bool, error) {
+	client := csi.NewIdentityClient(c.conn)
+
+	req := &csi.ProbeRequest{
+		Version: &csiVersion,
+	}
+	rsp, err := client.Probe(ctx, req)
+	if err != nil {
+		return false, err
+	}
+	if rsp.Ready == nil {
+		// A driver that does not populate Ready is assumed to always be
+		// ready, per the CSI spec.
+		return true, nil
+	}
+	return rsp.Ready.Value, nil
+}
+
+func (c *csiConnection) GetDriverName(ctx context.Context) (string, error) {
+	c.driverNameOnce.Do(func() {
+		client := csi.NewIdentityClient(c.conn)
+
+		req := csi.GetPluginInfoRequest{
+			Version: &csiVersion,
+		}
+
+		rsp, err := client.GetPluginInfo(ctx, &req)
+		if err != nil {
+			c.driverNameErr = err
+			return
+		}
+		name := rsp.GetName()
+		if name == "" {
+			c.driverNameErr = fmt.Errorf("driver name is empty")
+			return
+		}
+		c.driverName = name
+	})
+	return c.driverName, c.driverNameErr
+}
+
+func (c *csiConnection) GetPluginCapabilities(ctx context.Context) (PluginCapabilitySet, error) {
+	c.capMutex.Lock()
+	defer c.capMutex.Unlock()
+	if c.pluginCapabilities != nil {
+		return c.pluginCapabilities, nil
+	}
+
+	client := csi.NewIdentityClient(c.conn)
+	req := csi.GetPluginCapabilitiesRequest{
+		Version: &csiVersion,
+	}
+	rsp, err := client.GetPluginCapabilities(ctx, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	caps := PluginCapabilitySet{}
+	for _, capability := range rsp.GetCapabilities() {
+		if capability == nil || capability.GetService() == nil {
+			continue
+		}
+		caps[capability.GetService().GetType()] = true
+	}
+	c.pluginCapabilities = caps
+	return caps, nil
+}
+
+func (c *csiConnection) SupportsControllerPublish(ctx context.Context) (bool, error) {
+	c.controllerPublishOnce.Do(func() {
+		client := csi.NewControllerClient(c.controllerConn)
+		req := csi.ControllerGetCapabilitiesRequest{
+			Version: &csiVersion,
+		}
+		rsp, err := client.ControllerGetCapabilities(ctx, &req)
+		if err != nil {
+			c.controllerPublishErr = err
+			return
+		}
+		for _, capability := range rsp.GetCapabilities() {
+			if capability == nil || capability.GetRpc() == nil {
+				continue
+			}
+			if capability.GetRpc().GetType() == csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME {
+				c.controllerPublish = true
+			}
+		}
+	})
+	return c.controllerPublish, c.controllerPublishErr
+}
+
+func (c *csiConnection) Attach(ctx context.Context, volumeID string, readOnly bool, nodeID string, caps *csi.VolumeCapability) (map[string]string, bool, error) {
+	client := csi.NewControllerClient(c.controllerConn)
+
+	req := csi.ControllerPublishVolumeRequest{
+		Version:          &csiVersion,
+		VolumeId:         volumeID,
+		NodeId:           nodeID,
+		VolumeCapability: caps,
+		Readonly:         readOnly,
+	}
+
+	var rsp *csi.ControllerPublishVolumeResponse
+	err := c.retryPolicy.call(ctx, func() error {
+		var callErr error
+		rsp, callErr = client.ControllerPublishVolume(ctx, &req)
+		return callErr
+	})
+	if err != nil {
+		return nil, IsFinalError(err), err
+	}
+
+	return rsp.GetPublishVolumeInfo(), false, nil
+}
+
+func (c *csiConnection) Detach(ctx context.Context, volumeID string, nodeID string) (bool, error) {
+	client := csi.NewControllerClient(c.controllerConn)
+
+	req := csi.ControllerUnpublishVolumeRequest{
+		Version:  &csiVersion,
+		VolumeId: volumeID,
+		NodeId:   nodeID,
+	}
+
+	err := c.retryPolicy.call(ctx, func() error {
+		_, callErr := client.ControllerUnpublishVolume(ctx, &req)
+		return callErr
+	})
+	if err != nil {
+		return IsFinalError(err), err
+	}
+
+	return true, nil
+}
+
+func (c *csiConnection) SupportsControllerExpand(ctx context.Context) (bool, error) {
+	c.controllerExpandOnce.Do(func() {
+		client := csi.NewControllerClient(c.controllerConn)
+		req := csi.ControllerGetCapabilitiesRequest{
+			Version: &csiVersion,
+		}
+		rsp, err := client.ControllerGetCapabilities(ctx, &req)
+		if err != nil {
+			c.controllerExpandErr = err
+			return
+		}
+		for _, capability := range rsp.GetCapabilities() {
+			if capability == nil || capability.GetRpc() == nil {
+				continue
+			}
+			if capability.GetRpc().GetType() == csi.ControllerServiceCapability_RPC_EXPAND_VOLUME {
+				c.controllerExpand = true
+			}
+		}
+	})
+	return c.controllerExpand, c.controllerExpandErr
+}
+
+func (c *csiConnection) Expand(ctx context.Context, volumeID string, newSize int64, secrets map[string]string, capability *csi.VolumeCapability) (int64, bool, error) {
+	client := csi.NewControllerClient(c.controllerConn)
+
+	req := csi.ControllerExpandVolumeRequest{
+		Version:          &csiVersion,
+		VolumeId:         volumeID,
+		CapacityRange:    &csi.CapacityRange{RequiredBytes: newSize},
+		Secrets:          secrets,
+		VolumeCapability: capability,
+	}
+
+	var rsp *csi.ControllerExpandVolumeResponse
+	err := c.retryPolicy.call(ctx, func() error {
+		var callErr error
+		rsp, callErr = client.ControllerExpandVolume(ctx, &req)
+		return callErr
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	return rsp.GetCapacityBytes(), rsp.GetNodeExpansionRequired(), nil
+}
+
+func (c *csiConnection) Close() error {
+	if c.controllerConn != c.conn {
+		if err := c.controllerConn.Close(); err != nil {
+			return err
+		}
+	}
+	return c.conn.Close()
+}
+
+// IsFinalError returns true if the given error is a final, non-retryable
+// error returned by the CSI driver, using the DefaultRetryPolicy's
+// classifier. Attach, Detach and Expand no longer need this themselves
+// since they retry internally under the connection's RetryPolicy, but
+// callers like the resize controller still use it to decide whether a
+// failed call should be reported as terminal.
+func IsFinalError(err error) bool {
+	return err != nil && !DefaultRetryPolicy().IsRetryable(err)
+}
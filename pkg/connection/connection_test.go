@@ -21,9 +21,11 @@ import (
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/kubernetes-csi/csi-test/driver"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -44,9 +46,11 @@ func createMockServer(t *testing.T) (*gomock.Controller, *driver.MockCSIDriver,
 	})
 	drv.Start()
 
-	// Create a client connection to it
+	// Create a client connection to it. Tests that use this helper drive
+	// exactly one RPC per table-test case, so retries are disabled here;
+	// retry behavior itself is covered by TestRetryPolicy below.
 	addr := drv.Address()
-	csiConn, err := New(addr, 10)
+	csiConn, err := New(addr, 10, WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
 	if err != nil {
 		return nil, nil, nil, nil, nil, err
 	}
@@ -87,15 +91,14 @@ func TestGetPluginInfo(t *testing.T) {
 		},
 	}
 
-	mockController, driver, identityServer, _, csiConn, err := createMockServer(t)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer mockController.Finish()
-	defer driver.Stop()
-	defer csiConn.Close()
-
 	for _, test := range tests {
+		// Each case gets its own connection: GetDriverName caches its
+		// result, so reusing one connection across cases would only
+		// hit the wire for the first case.
+		mockController, driver, identityServer, _, csiConn, err := createMockServer(t)
+		if err != nil {
+			t.Fatal(err)
+		}
 
 		in := &csi.GetPluginInfoRequest{
 			Version: &csi.Version{
@@ -124,6 +127,41 @@ func TestGetPluginInfo(t *testing.T) {
 		if err == nil && name != "csi/example" {
 			t.Errorf("got unexpected name: %q", name)
 		}
+
+		mockController.Finish()
+		driver.Stop()
+		csiConn.Close()
+	}
+}
+
+func TestGetDriverNameIsCached(t *testing.T) {
+	mockController, driver, identityServer, _, csiConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+	defer csiConn.Close()
+
+	in := &csi.GetPluginInfoRequest{
+		Version: &csiVersion,
+	}
+	out := &csi.GetPluginInfoResponse{
+		Name: "csi/example",
+	}
+
+	// Even though GetDriverName is called twice, the RPC must only fire
+	// once: the second call should be served from the cache.
+	identityServer.EXPECT().GetPluginInfo(gomock.Any(), in).Return(out, nil).Times(1)
+
+	for i := 0; i < 2; i++ {
+		name, err := csiConn.GetDriverName(context.Background())
+		if err != nil {
+			t.Errorf("got error: %v", err)
+		}
+		if name != "csi/example" {
+			t.Errorf("got unexpected name: %q", name)
+		}
 	}
 }
 
@@ -197,15 +235,14 @@ func TestSupportsControllerPublish(t *testing.T) {
 		},
 	}
 
-	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer mockController.Finish()
-	defer driver.Stop()
-	defer csiConn.Close()
-
 	for _, test := range tests {
+		// Each case gets its own connection: SupportsControllerPublish
+		// caches its result, so reusing one connection across cases
+		// would only hit the wire for the first case.
+		mockController, driver, _, controllerServer, csiConn, err := createMockServer(t)
+		if err != nil {
+			t.Fatal(err)
+		}
 
 		in := &csi.ControllerGetCapabilitiesRequest{
 			Version: &csi.Version{
@@ -231,6 +268,179 @@ func TestSupportsControllerPublish(t *testing.T) {
 		if !test.expectError && err != nil {
 			t.Errorf("test %q: got error: %v", test.name, err)
 		}
+
+		mockController.Finish()
+		driver.Stop()
+		csiConn.Close()
+	}
+}
+
+func TestSupportsControllerPublishIsCached(t *testing.T) {
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+	defer csiConn.Close()
+
+	in := &csi.ControllerGetCapabilitiesRequest{
+		Version: &csiVersion,
+	}
+	out := &csi.ControllerGetCapabilitiesResponse{
+		Capabilities: []*csi.ControllerServiceCapability{
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+					},
+				},
+			},
+		},
+	}
+
+	// Even though SupportsControllerPublish is called twice, the RPC
+	// must only fire once: the second call should be served from the
+	// cache.
+	controllerServer.EXPECT().ControllerGetCapabilities(gomock.Any(), in).Return(out, nil).Times(1)
+
+	for i := 0; i < 2; i++ {
+		supported, err := csiConn.SupportsControllerPublish(context.Background())
+		if err != nil {
+			t.Errorf("got error: %v", err)
+		}
+		if !supported {
+			t.Errorf("expected controller publish to be supported")
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name        string
+		ready       *wrappers.BoolValue
+		injectError bool
+		expectReady bool
+		expectError bool
+	}{
+		{
+			name:        "ready",
+			ready:       &wrappers.BoolValue{Value: true},
+			expectReady: true,
+		},
+		{
+			name:        "not ready",
+			ready:       &wrappers.BoolValue{Value: false},
+			expectReady: false,
+		},
+		{
+			name:        "ready not set",
+			ready:       nil,
+			expectReady: true,
+		},
+		{
+			name:        "gRPC error",
+			injectError: true,
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		mockController, driver, identityServer, _, csiConn, err := createMockServer(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var injectedErr error
+		if test.injectError {
+			injectedErr = fmt.Errorf("mock error")
+		}
+
+		identityServer.EXPECT().Probe(gomock.Any(), &csi.ProbeRequest{Version: &csiVersion}).
+			Return(&csi.ProbeResponse{Ready: test.ready}, injectedErr).Times(1)
+
+		ready, err := csiConn.Probe(context.Background())
+		if test.expectError && err == nil {
+			t.Errorf("test %q: expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if err == nil && ready != test.expectReady {
+			t.Errorf("test %q: expected ready=%v, got %v", test.name, test.expectReady, ready)
+		}
+
+		mockController.Finish()
+		driver.Stop()
+		csiConn.Close()
+	}
+}
+
+func TestGetPluginCapabilities(t *testing.T) {
+	tests := []struct {
+		name         string
+		output       *csi.GetPluginCapabilitiesResponse
+		injectError  bool
+		expectError  bool
+		expectedCaps PluginCapabilitySet
+	}{
+		{
+			name: "controller service",
+			output: &csi.GetPluginCapabilitiesResponse{
+				Capabilities: []*csi.PluginCapability{
+					{
+						Type: &csi.PluginCapability_Service_{
+							Service: &csi.PluginCapability_Service{
+								Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+							},
+						},
+					},
+				},
+			},
+			expectedCaps: PluginCapabilitySet{
+				csi.PluginCapability_Service_CONTROLLER_SERVICE: true,
+			},
+		},
+		{
+			name:        "gRPC error",
+			injectError: true,
+			expectError: true,
+		},
+		{
+			name:         "no capabilities",
+			output:       &csi.GetPluginCapabilitiesResponse{},
+			expectedCaps: PluginCapabilitySet{},
+		},
+	}
+
+	for _, test := range tests {
+		mockController, driver, identityServer, _, csiConn, err := createMockServer(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var injectedErr error
+		if test.injectError {
+			injectedErr = fmt.Errorf("mock error")
+		}
+
+		identityServer.EXPECT().GetPluginCapabilities(gomock.Any(), &csi.GetPluginCapabilitiesRequest{Version: &csiVersion}).
+			Return(test.output, injectedErr).Times(1)
+
+		caps, err := csiConn.GetPluginCapabilities(context.Background())
+		if test.expectError && err == nil {
+			t.Errorf("test %q: expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if err == nil && !reflect.DeepEqual(caps, test.expectedCaps) {
+			t.Errorf("test %q: got unexpected capabilities: %+v", test.name, caps)
+		}
+
+		mockController.Finish()
+		driver.Stop()
+		csiConn.Close()
 	}
 }
 
@@ -462,3 +672,348 @@ func TestDetachAttach(t *testing.T) {
 		}
 	}
 }
+
+func TestRetryPolicy(t *testing.T) {
+	fastRetryPolicy := RetryPolicy{
+		MaxAttempts:       5,
+		InitialBackoff:    time.Millisecond,
+		MaxBackoff:        10 * time.Millisecond,
+		BackoffMultiplier: 2,
+	}
+
+	t.Run("retries on Unavailable then succeeds", func(t *testing.T) {
+		mockController := gomock.NewController(t)
+		identityServer := driver.NewMockIdentityServer(mockController)
+		controllerServer := driver.NewMockControllerServer(mockController)
+		drv := driver.NewMockCSIDriver(&driver.MockCSIDriverServers{
+			Identity:   identityServer,
+			Controller: controllerServer,
+		})
+		drv.Start()
+		defer drv.Stop()
+		defer mockController.Finish()
+
+		csiConn, err := New(drv.Address(), 10, WithRetryPolicy(fastRetryPolicy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer csiConn.Close()
+
+		req := &csi.ControllerUnpublishVolumeRequest{
+			Version:  &csiVersion,
+			VolumeId: "myname",
+			NodeId:   "MyNodeID",
+		}
+		gomock.InOrder(
+			controllerServer.EXPECT().ControllerUnpublishVolume(gomock.Any(), req).
+				Return(nil, status.Error(codes.Unavailable, "busy")).Times(1),
+			controllerServer.EXPECT().ControllerUnpublishVolume(gomock.Any(), req).
+				Return(nil, status.Error(codes.Unavailable, "busy")).Times(1),
+			controllerServer.EXPECT().ControllerUnpublishVolume(gomock.Any(), req).
+				Return(&csi.ControllerUnpublishVolumeResponse{}, nil).Times(1),
+		)
+
+		detached, err := csiConn.Detach(context.Background(), "myname", "MyNodeID")
+		if err != nil {
+			t.Fatalf("expected eventual success, got error: %v", err)
+		}
+		if !detached {
+			t.Errorf("expected detached=true")
+		}
+	})
+
+	t.Run("fails immediately on NotFound", func(t *testing.T) {
+		mockController := gomock.NewController(t)
+		identityServer := driver.NewMockIdentityServer(mockController)
+		controllerServer := driver.NewMockControllerServer(mockController)
+		drv := driver.NewMockCSIDriver(&driver.MockCSIDriverServers{
+			Identity:   identityServer,
+			Controller: controllerServer,
+		})
+		drv.Start()
+		defer drv.Stop()
+		defer mockController.Finish()
+
+		csiConn, err := New(drv.Address(), 10, WithRetryPolicy(fastRetryPolicy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer csiConn.Close()
+
+		req := &csi.ControllerUnpublishVolumeRequest{
+			Version:  &csiVersion,
+			VolumeId: "myname",
+			NodeId:   "MyNodeID",
+		}
+		controllerServer.EXPECT().ControllerUnpublishVolume(gomock.Any(), req).
+			Return(nil, status.Error(codes.NotFound, "no such volume")).Times(1)
+
+		detached, err := csiConn.Detach(context.Background(), "myname", "MyNodeID")
+		if err == nil {
+			t.Fatal("expected error, got none")
+		}
+		if !detached {
+			t.Errorf("expected detached=true for a final error")
+		}
+	})
+}
+
+func TestNewSplit(t *testing.T) {
+	// Two independent mock drivers, one standing in for the controller-only
+	// socket and one for the identity (node) socket.
+	// createMockServer also dials its own connection to the driver it
+	// starts; that connection is unused here (NewSplit below dials its own
+	// pair) but still needs closing, or it leaks a live grpc.ClientConn.
+	controllerMockController, controllerDriver, _, controllerServer, controllerConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer controllerMockController.Finish()
+	defer controllerDriver.Stop()
+	defer controllerConn.Close()
+
+	identityMockController, identityDriver, identityServer, _, identityConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer identityMockController.Finish()
+	defer identityDriver.Stop()
+	defer identityConn.Close()
+
+	csiConn, err := NewSplit(controllerDriver.Address(), identityDriver.Address(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer csiConn.Close()
+
+	identityServer.EXPECT().GetPluginInfo(gomock.Any(), &csi.GetPluginInfoRequest{Version: &csiVersion}).
+		Return(&csi.GetPluginInfoResponse{Name: "csi/example"}, nil).Times(1)
+
+	name, err := csiConn.GetDriverName(context.Background())
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if name != "csi/example" {
+		t.Errorf("got unexpected name: %q", name)
+	}
+
+	controllerServer.EXPECT().ControllerGetCapabilities(gomock.Any(), &csi.ControllerGetCapabilitiesRequest{Version: &csiVersion}).
+		Return(&csi.ControllerGetCapabilitiesResponse{
+			Capabilities: []*csi.ControllerServiceCapability{
+				{
+					Type: &csi.ControllerServiceCapability_Rpc{
+						Rpc: &csi.ControllerServiceCapability_RPC{
+							Type: csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+						},
+					},
+				},
+			},
+		}, nil).Times(1)
+
+	supported, err := csiConn.SupportsControllerPublish(context.Background())
+	if err != nil {
+		t.Fatalf("got error: %v", err)
+	}
+	if !supported {
+		t.Errorf("expected controller publish to be supported")
+	}
+}
+
+func TestSupportsControllerExpand(t *testing.T) {
+	tests := []struct {
+		name        string
+		output      *csi.ControllerGetCapabilitiesResponse
+		injectError bool
+		expectError bool
+		expectYes   bool
+	}{
+		{
+			name: "success",
+			output: &csi.ControllerGetCapabilitiesResponse{
+				Capabilities: []*csi.ControllerServiceCapability{
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								Type: csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+							},
+						},
+					},
+				},
+			},
+			expectYes: true,
+		},
+		{
+			name: "no expand capability",
+			output: &csi.ControllerGetCapabilitiesResponse{
+				Capabilities: []*csi.ControllerServiceCapability{
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								Type: csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+							},
+						},
+					},
+				},
+			},
+			expectYes: false,
+		},
+		{
+			name:        "gRPC error",
+			injectError: true,
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		mockController, driver, _, controllerServer, csiConn, err := createMockServer(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var injectedErr error
+		if test.injectError {
+			injectedErr = fmt.Errorf("mock error")
+		}
+
+		controllerServer.EXPECT().ControllerGetCapabilities(gomock.Any(), &csi.ControllerGetCapabilitiesRequest{Version: &csiVersion}).
+			Return(test.output, injectedErr).Times(1)
+
+		supported, err := csiConn.SupportsControllerExpand(context.Background())
+		if test.expectError && err == nil {
+			t.Errorf("test %q: expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if err == nil && supported != test.expectYes {
+			t.Errorf("test %q: expected supported=%v, got %v", test.name, test.expectYes, supported)
+		}
+
+		mockController.Finish()
+		driver.Stop()
+		csiConn.Close()
+	}
+}
+
+func TestExpand(t *testing.T) {
+	defaultVolumeID := "myname"
+	defaultNewSize := int64(2 * 1024 * 1024 * 1024)
+	defaultCaps := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		},
+	}
+	defaultRequest := &csi.ControllerExpandVolumeRequest{
+		Version:          &csiVersion,
+		VolumeId:         defaultVolumeID,
+		CapacityRange:    &csi.CapacityRange{RequiredBytes: defaultNewSize},
+		VolumeCapability: defaultCaps,
+	}
+
+	tests := []struct {
+		name                string
+		output              *csi.ControllerExpandVolumeResponse
+		injectError         codes.Code
+		expectError         bool
+		expectCapacity      int64
+		expectNodeExpansion bool
+	}{
+		{
+			name: "success",
+			output: &csi.ControllerExpandVolumeResponse{
+				CapacityBytes:         defaultNewSize,
+				NodeExpansionRequired: true,
+			},
+			expectCapacity:      defaultNewSize,
+			expectNodeExpansion: true,
+		},
+		{
+			name:        "final error",
+			injectError: codes.NotFound,
+			expectError: true,
+		},
+		{
+			name:        "transient error",
+			injectError: codes.DeadlineExceeded,
+			expectError: true,
+		},
+	}
+
+	mockController, driver, _, controllerServer, csiConn, err := createMockServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockController.Finish()
+	defer driver.Stop()
+	defer csiConn.Close()
+
+	for _, test := range tests {
+		out := test.output
+		var injectedErr error
+		if test.injectError != codes.OK {
+			injectedErr = status.Error(test.injectError, fmt.Sprintf("Injecting error %d", test.injectError))
+		}
+
+		controllerServer.EXPECT().ControllerExpandVolume(gomock.Any(), defaultRequest).Return(out, injectedErr).Times(1)
+
+		newCapacity, nodeExpansionRequired, err := csiConn.Expand(context.Background(), defaultVolumeID, defaultNewSize, nil, defaultCaps)
+		if test.expectError && err == nil {
+			t.Errorf("test %q: expected error, got none", test.name)
+		}
+		if !test.expectError && err != nil {
+			t.Errorf("test %q: got error: %v", test.name, err)
+		}
+		if err == nil {
+			if newCapacity != test.expectCapacity {
+				t.Errorf("test %q: expected capacity=%d, got %d", test.name, test.expectCapacity, newCapacity)
+			}
+			if nodeExpansionRequired != test.expectNodeExpansion {
+				t.Errorf("test %q: expected nodeExpansionRequired=%v, got %v", test.name, test.expectNodeExpansion, nodeExpansionRequired)
+			}
+		}
+	}
+}
+
+// TestWaitForReadyPollsUntilReady exercises WithWaitForReady's poll-until-
+// ready loop: the mock driver reports not-ready twice before New is allowed
+// to return, proving New actually blocks on Probe rather than returning
+// immediately.
+func TestWaitForReadyPollsUntilReady(t *testing.T) {
+	mockController := gomock.NewController(t)
+	identityServer := driver.NewMockIdentityServer(mockController)
+	controllerServer := driver.NewMockControllerServer(mockController)
+	drv := driver.NewMockCSIDriver(&driver.MockCSIDriverServers{
+		Identity:   identityServer,
+		Controller: controllerServer,
+	})
+	drv.Start()
+	defer drv.Stop()
+	defer mockController.Finish()
+
+	probeReq := &csi.ProbeRequest{Version: &csiVersion}
+	gomock.InOrder(
+		identityServer.EXPECT().Probe(gomock.Any(), probeReq).
+			Return(&csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: false}}, nil).Times(1),
+		identityServer.EXPECT().Probe(gomock.Any(), probeReq).
+			Return(&csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: false}}, nil).Times(1),
+		identityServer.EXPECT().Probe(gomock.Any(), probeReq).
+			Return(&csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil).Times(1),
+	)
+
+	probeInterval := 20 * time.Millisecond
+	start := time.Now()
+	csiConn, err := New(drv.Address(), 10, WithWaitForReady(), WithProbeInterval(probeInterval))
+	if err != nil {
+		t.Fatalf("expected New to succeed once the driver reports ready, got: %v", err)
+	}
+	defer csiConn.Close()
+
+	// Two not-ready polls must elapse before the third, ready one, so New
+	// cannot have returned immediately.
+	if elapsed := time.Since(start); elapsed < 2*probeInterval {
+		t.Errorf("expected New to block across the not-ready polls, returned after only %v", elapsed)
+	}
+}
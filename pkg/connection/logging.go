@@ -0,0 +1,61 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connection
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+)
+
+// secretsScrubbed is logged in place of any field carrying driver secrets.
+const secretsScrubbed = "***stripped***"
+
+// logGRPC is a grpc.UnaryClientInterceptor that logs sanitized request and
+// response payloads for every CSI RPC, with secrets redacted so they never
+// end up in the attacher's logs.
+func logGRPC(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	glog.V(5).Infof("GRPC call: %s", method)
+	glog.V(5).Infof("GRPC request: %s", sanitize(req))
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	glog.V(5).Infof("GRPC response: %s", sanitize(reply))
+	glog.V(5).Infof("GRPC error: %v", err)
+	return err
+}
+
+// sanitize returns a string representation of a CSI request/response with
+// any secrets field blanked out, so raw driver secrets never reach the log.
+func sanitize(obj interface{}) string {
+	switch req := obj.(type) {
+	case *csi.ControllerPublishVolumeRequest:
+		if len(req.GetControllerPublishSecrets()) > 0 {
+			clone := *req
+			clone.ControllerPublishSecrets = map[string]string{"redacted": secretsScrubbed}
+			return fmt.Sprintf("%+v", &clone)
+		}
+	case *csi.ControllerExpandVolumeRequest:
+		if len(req.GetSecrets()) > 0 {
+			clone := *req
+			clone.Secrets = map[string]string{"redacted": secretsScrubbed}
+			return fmt.Sprintf("%+v", &clone)
+		}
+	}
+	return fmt.Sprintf("%+v", obj)
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connection
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy controls how Attach, Detach and Expand retry a CSI RPC that
+// fails with a retryable gRPC code, under the deadline of the context the
+// caller passed in.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times the RPC is tried,
+	// including the first attempt. Zero means unlimited attempts (the
+	// caller's context deadline is the only bound).
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+
+	// BackoffMultiplier is applied to the backoff after each retry.
+	BackoffMultiplier float64
+
+	// Jitter is the fraction (0-1) of the computed backoff that is
+	// randomized, to avoid retry storms when many callers back off in
+	// lockstep.
+	Jitter float64
+}
+
+// DefaultRetryPolicy is used by New/NewSplit when the caller does not
+// supply a WithRetryPolicy option.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:       0,
+		InitialBackoff:    1 * time.Second,
+		MaxBackoff:        5 * time.Minute,
+		BackoffMultiplier: 2,
+		Jitter:            0.2,
+	}
+}
+
+// IsRetryable returns true if err is a gRPC error whose code indicates the
+// call can be retried: the driver was momentarily unavailable, busy, timed
+// out, or reported an operation already in progress for the volume.
+func (p RetryPolicy) IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	switch st.Code() {
+	case codes.DeadlineExceeded, // gRPC: Timeout
+		codes.Unavailable,       // gRPC: Server shutting down, TCP connection broken
+		codes.ResourceExhausted, // gRPC: Server temporarily out of resources
+		codes.Aborted:           // CSI: Operation pending for volume
+		return true
+	}
+	return false
+}
+
+// backoff returns the delay to wait before the given retry attempt
+// (attempt is 1 for the first retry), with jitter applied.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		delay *= p.BackoffMultiplier
+	}
+	if max := float64(p.MaxBackoff); delay > max {
+		delay = max
+	}
+	if p.Jitter > 0 {
+		delay += (rand.Float64()*2 - 1) * p.Jitter * delay
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay)
+}
+
+// call runs fn, retrying it under policy until it succeeds, returns a
+// non-retryable error, ctx is done, or MaxAttempts is reached.
+func (p RetryPolicy) call(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || !p.IsRetryable(err) {
+			return err
+		}
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(p.backoff(attempt)):
+		}
+	}
+}
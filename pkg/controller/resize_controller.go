@@ -0,0 +1,368 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/kubernetes-csi/external-attacher/pkg/connection"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	// FailedExpandVolume is the event reason used when a ControllerExpandVolume
+	// call fails with a final, non-retryable error.
+	FailedExpandVolume = "FailedExpandVolume"
+
+	// VolumeResizeSuccessful is the event reason used when a resize completes.
+	VolumeResizeSuccessful = "VolumeResizeSuccessful"
+
+	resizeControllerName = "resize-controller"
+
+	// resizeRPCTimeout bounds a single ControllerExpandVolume (and its
+	// preceding ControllerGetCapabilities) call. RetryPolicy.call retries
+	// retryable errors indefinitely, bounded only by the context deadline,
+	// so syncPVC must supply one: otherwise a persistently unreachable
+	// driver wedges the workqueue worker instead of letting
+	// claimQueue.AddRateLimited back off normally.
+	resizeRPCTimeout = time.Minute
+)
+
+// ResizeController watches PersistentVolumeClaims whose requested storage
+// size no longer matches their status capacity and drives the CSI
+// ControllerExpandVolume RPC to reconcile them, mirroring how the attach
+// controller reconciles VolumeAttachments.
+type ResizeController struct {
+	name       string
+	csiClient  connection.CSIConnection
+	kubeClient kubernetes.Interface
+
+	pvcLister corelisters.PersistentVolumeClaimLister
+	pvcSynced cache.InformerSynced
+
+	pvLister corelisters.PersistentVolumeLister
+	pvSynced cache.InformerSynced
+
+	claimQueue    workqueue.RateLimitingInterface
+	eventRecorder record.EventRecorder
+}
+
+// NewResizeController creates a new ResizeController for the given CSI
+// driver name. pvInformer is used to resolve a PVC's bound PersistentVolume
+// down to the CSI volume handle that identifies it to the driver.
+func NewResizeController(
+	name string,
+	csiClient connection.CSIConnection,
+	kubeClient kubernetes.Interface,
+	pvcInformer coreinformers.PersistentVolumeClaimInformer,
+	pvInformer coreinformers.PersistentVolumeInformer,
+) *ResizeController {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: kubeClient.CoreV1().Events(v1.NamespaceAll)})
+	eventRecorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: fmt.Sprintf("%s %s", resizeControllerName, name)})
+
+	ctrl := &ResizeController{
+		name:          name,
+		csiClient:     csiClient,
+		kubeClient:    kubeClient,
+		pvcLister:     pvcInformer.Lister(),
+		pvcSynced:     pvcInformer.Informer().HasSynced,
+		pvLister:      pvInformer.Lister(),
+		pvSynced:      pvInformer.Informer().HasSynced,
+		claimQueue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), resizeControllerName),
+		eventRecorder: eventRecorder,
+	}
+
+	pvcInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    ctrl.enqueuePVC,
+		UpdateFunc: func(old, new interface{}) { ctrl.enqueuePVC(new) },
+	})
+
+	return ctrl
+}
+
+func (ctrl *ResizeController) enqueuePVC(obj interface{}) {
+	pvc, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		return
+	}
+	if !needsResize(pvc) {
+		return
+	}
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(pvc)
+	if err != nil {
+		glog.Errorf("failed to get key for PVC %s/%s: %v", pvc.Namespace, pvc.Name, err)
+		return
+	}
+	ctrl.claimQueue.Add(key)
+}
+
+// needsResize returns true if a PVC's requested storage is larger than
+// what its status currently reports.
+func needsResize(pvc *v1.PersistentVolumeClaim) bool {
+	requested, ok := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	if !ok {
+		return false
+	}
+	actual, ok := pvc.Status.Capacity[v1.ResourceStorage]
+	if !ok {
+		return false
+	}
+	return requested.Cmp(actual) > 0
+}
+
+// Run starts the controller's workers and blocks until stopCh is closed.
+func (ctrl *ResizeController) Run(workers int, stopCh <-chan struct{}) {
+	defer ctrl.claimQueue.ShutDown()
+
+	glog.Infof("starting %s for driver %s", resizeControllerName, ctrl.name)
+	defer glog.Infof("shutting down %s for driver %s", resizeControllerName, ctrl.name)
+
+	if !cache.WaitForCacheSync(stopCh, ctrl.pvcSynced, ctrl.pvSynced) {
+		return
+	}
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for ctrl.processNextWorkItem() {
+			}
+		}()
+	}
+
+	<-stopCh
+}
+
+func (ctrl *ResizeController) processNextWorkItem() bool {
+	key, shutdown := ctrl.claimQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer ctrl.claimQueue.Done(key)
+
+	if err := ctrl.syncPVC(key.(string)); err != nil {
+		glog.Warningf("error syncing PVC %q, will retry: %v", key, err)
+		ctrl.claimQueue.AddRateLimited(key)
+		return true
+	}
+
+	ctrl.claimQueue.Forget(key)
+	return true
+}
+
+func (ctrl *ResizeController) syncPVC(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	pvc, err := ctrl.pvcLister.PersistentVolumeClaims(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !needsResize(pvc) {
+		return nil
+	}
+
+	pv, err := ctrl.resolvePV(pvc)
+	if err != nil {
+		return err
+	}
+	if pv == nil {
+		// Bound to a PV that isn't ours; nothing to do.
+		return nil
+	}
+
+	requested := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	newSize := requested.Value()
+
+	secrets, err := ctrl.controllerExpandSecrets(pv)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resizeRPCTimeout)
+	defer cancel()
+
+	supported, err := ctrl.csiClient.SupportsControllerExpand(ctx)
+	if err != nil {
+		return err
+	}
+	if !supported {
+		glog.V(4).Infof("driver %s does not support controller expand, skipping PVC %s/%s", ctrl.name, namespace, name)
+		return nil
+	}
+
+	newCapacity, nodeExpansionRequired, err := ctrl.csiClient.Expand(ctx, pv.Spec.CSI.VolumeHandle, newSize, secrets, volumeCapabilityFromPV(pv))
+	if err != nil {
+		if connection.IsFinalError(err) {
+			ctrl.eventRecorder.Eventf(pvc, v1.EventTypeWarning, FailedExpandVolume, "resize failed: %v", err)
+			return nil
+		}
+		return err
+	}
+
+	if err := ctrl.updatePVCStatus(pvc, newCapacity, nodeExpansionRequired); err != nil {
+		return fmt.Errorf("resized PVC %s/%s but failed to update its status: %v", namespace, name, err)
+	}
+
+	ctrl.eventRecorder.Eventf(pvc, v1.EventTypeNormal, VolumeResizeSuccessful, "resized to %s", resource.NewQuantity(newCapacity, resource.BinarySI))
+	return nil
+}
+
+// resolvePV looks up the PersistentVolume a PVC is bound to. pvc.Spec.
+// VolumeName is only the PV object's name, not the backend volume ID the
+// driver understands; that lives at PV.Spec.CSI.VolumeHandle, which callers
+// should read off the returned PV. It returns a nil PV, and no error, for a
+// PV that isn't a CSI volume provisioned by ctrl.name, since the PVC
+// informer watches claims bound to every driver, not just this one.
+func (ctrl *ResizeController) resolvePV(pvc *v1.PersistentVolumeClaim) (*v1.PersistentVolume, error) {
+	if pvc.Spec.VolumeName == "" {
+		return nil, fmt.Errorf("PVC %s/%s requests resize but is not yet bound to a PersistentVolume", pvc.Namespace, pvc.Name)
+	}
+
+	pv, err := ctrl.pvLister.Get(pvc.Spec.VolumeName)
+	if err != nil {
+		return nil, err
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != ctrl.name {
+		glog.V(4).Infof("PersistentVolume %s is not provisioned by driver %s, skipping PVC %s/%s", pv.Name, ctrl.name, pvc.Namespace, pvc.Name)
+		return nil, nil
+	}
+	return pv, nil
+}
+
+// controllerExpandSecrets resolves the secret named by the bound
+// PersistentVolume's ControllerExpandSecretRef, if any, into the plain
+// map[string]string ControllerExpandVolume expects.
+func (ctrl *ResizeController) controllerExpandSecrets(pv *v1.PersistentVolume) (map[string]string, error) {
+	ref := pv.Spec.CSI.ControllerExpandSecretRef
+	if ref == nil {
+		return nil, nil
+	}
+
+	secret, err := ctrl.kubeClient.CoreV1().Secrets(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s/%s for ControllerExpandVolume: %v", ref.Namespace, ref.Name, err)
+	}
+
+	secrets := make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		secrets[k] = string(v)
+	}
+	return secrets, nil
+}
+
+// volumeCapabilityFromPV derives the csi.VolumeCapability ControllerExpandVolume
+// needs from the bound PersistentVolume's access modes, volume mode and fs
+// type, the same fields the rest of the CSI sidecars build a capability
+// from when one isn't otherwise supplied by the caller.
+func volumeCapabilityFromPV(pv *v1.PersistentVolume) *csi.VolumeCapability {
+	capability := &csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: accessModeFromPV(pv.Spec.AccessModes),
+		},
+	}
+
+	if pv.Spec.VolumeMode != nil && *pv.Spec.VolumeMode == v1.PersistentVolumeBlock {
+		capability.AccessType = &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		}
+	} else {
+		capability.AccessType = &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{
+				FsType: pv.Spec.CSI.FSType,
+			},
+		}
+	}
+
+	return capability
+}
+
+// accessModeFromPV maps a PersistentVolume's access modes to the single CSI
+// access mode that most closely matches, preferring the most permissive mode
+// present, and defaulting to single-writer when none of the wider modes are
+// set.
+func accessModeFromPV(modes []v1.PersistentVolumeAccessMode) csi.VolumeCapability_AccessMode_Mode {
+	for _, mode := range modes {
+		switch mode {
+		case v1.ReadWriteMany:
+			return csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+		case v1.ReadOnlyMany:
+			return csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+		}
+	}
+	return csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+}
+
+// updatePVCStatus patches pvc.Status.Capacity to the size the driver
+// reported after a successful ControllerExpandVolume call, and, when the
+// driver says node-side expansion is still required, sets the
+// FileSystemResizePending condition so that step can be tracked
+// separately. Without this, needsResize would keep comparing against the
+// stale Status.Capacity on every resync and re-invoke ControllerExpandVolume
+// forever.
+func (ctrl *ResizeController) updatePVCStatus(pvc *v1.PersistentVolumeClaim, newCapacity int64, nodeExpansionRequired bool) error {
+	updated := pvc.DeepCopy()
+	if updated.Status.Capacity == nil {
+		updated.Status.Capacity = v1.ResourceList{}
+	}
+	updated.Status.Capacity[v1.ResourceStorage] = *resource.NewQuantity(newCapacity, resource.BinarySI)
+
+	if nodeExpansionRequired {
+		setPVCResizeCondition(updated, v1.PersistentVolumeClaimCondition{
+			Type:               v1.PersistentVolumeClaimFileSystemResizePending,
+			Status:             v1.ConditionTrue,
+			LastTransitionTime: metav1.Now(),
+			Message:            "Waiting for user to (re-)start a pod to finish file system resize of volume on node.",
+		})
+	}
+
+	_, err := ctrl.kubeClient.CoreV1().PersistentVolumeClaims(updated.Namespace).UpdateStatus(updated)
+	return err
+}
+
+// setPVCResizeCondition replaces any existing condition of the same type
+// on pvc, or appends cond if none is present.
+func setPVCResizeCondition(pvc *v1.PersistentVolumeClaim, cond v1.PersistentVolumeClaimCondition) {
+	for i := range pvc.Status.Conditions {
+		if pvc.Status.Conditions[i].Type == cond.Type {
+			pvc.Status.Conditions[i] = cond
+			return
+		}
+	}
+	pvc.Status.Conditions = append(pvc.Status.Conditions, cond)
+}
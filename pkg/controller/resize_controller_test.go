@@ -0,0 +1,227 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/external-attacher/pkg/connection"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	testDriverName = "csi.example.com"
+	testNamespace  = "default"
+	testPVCName    = "my-pvc"
+	testPVName     = "pvc-1a2b3c4d"
+	testVolumeID   = "vol-abc123"
+)
+
+// fakeCSIConnection is a minimal connection.CSIConnection stand-in for
+// exercising syncPVC without a real gRPC driver. Only SupportsControllerExpand
+// and Expand are used by the resize controller; the rest are unused stubs.
+type fakeCSIConnection struct {
+	supportsExpand bool
+
+	expandCalls []fakeExpandCall
+
+	newCapacity           int64
+	nodeExpansionRequired bool
+	expandErr             error
+}
+
+type fakeExpandCall struct {
+	volumeID   string
+	secrets    map[string]string
+	capability *csi.VolumeCapability
+}
+
+func (f *fakeCSIConnection) GetDriverName(ctx context.Context) (string, error) { return testDriverName, nil }
+func (f *fakeCSIConnection) SupportsControllerPublish(ctx context.Context) (bool, error) {
+	return false, nil
+}
+func (f *fakeCSIConnection) GetPluginCapabilities(ctx context.Context) (connection.PluginCapabilitySet, error) {
+	return nil, nil
+}
+func (f *fakeCSIConnection) Probe(ctx context.Context) (bool, error) { return true, nil }
+func (f *fakeCSIConnection) Attach(ctx context.Context, volumeID string, readOnly bool, nodeID string, caps *csi.VolumeCapability) (map[string]string, bool, error) {
+	return nil, false, nil
+}
+func (f *fakeCSIConnection) Detach(ctx context.Context, volumeID string, nodeID string) (bool, error) {
+	return true, nil
+}
+func (f *fakeCSIConnection) SupportsControllerExpand(ctx context.Context) (bool, error) {
+	return f.supportsExpand, nil
+}
+func (f *fakeCSIConnection) Expand(ctx context.Context, volumeID string, newSize int64, secrets map[string]string, capability *csi.VolumeCapability) (int64, bool, error) {
+	f.expandCalls = append(f.expandCalls, fakeExpandCall{volumeID: volumeID, secrets: secrets, capability: capability})
+	if f.expandErr != nil {
+		return 0, false, f.expandErr
+	}
+	return f.newCapacity, f.nodeExpansionRequired, nil
+}
+func (f *fakeCSIConnection) Close() error { return nil }
+
+// newTestController builds a ResizeController backed by a fake clientset and
+// informer indexers pre-loaded with pvc and pv, without starting the
+// informer factory (the indexers are populated directly, so there is no
+// asynchronous sync to wait for).
+func newTestController(csiClient *fakeCSIConnection, pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume) (*ResizeController, *fake.Clientset) {
+	kubeClient := fake.NewSimpleClientset(pvc, pv)
+	factory := informers.NewSharedInformerFactory(kubeClient, 0)
+	pvcInformer := factory.Core().V1().PersistentVolumeClaims()
+	pvInformer := factory.Core().V1().PersistentVolumes()
+
+	pvcInformer.Informer().GetIndexer().Add(pvc)
+	pvInformer.Informer().GetIndexer().Add(pv)
+
+	ctrl := NewResizeController(testDriverName, csiClient, kubeClient, pvcInformer, pvInformer)
+	return ctrl, kubeClient
+}
+
+func testPVC(requested, actual string) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testPVCName},
+		Spec: v1.PersistentVolumeClaimSpec{
+			VolumeName: testPVName,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse(requested)},
+			},
+		},
+		Status: v1.PersistentVolumeClaimStatus{
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse(actual)},
+		},
+	}
+}
+
+func testPV() *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: testPVName},
+		Spec: v1.PersistentVolumeSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{
+					Driver:       testDriverName,
+					VolumeHandle: testVolumeID,
+				},
+			},
+		},
+	}
+}
+
+func TestSyncPVCUsesVolumeHandleFromBoundPV(t *testing.T) {
+	pvc := testPVC("2Gi", "1Gi")
+	pv := testPV()
+	csiClient := &fakeCSIConnection{supportsExpand: true, newCapacity: 2 * 1024 * 1024 * 1024}
+	ctrl, _ := newTestController(csiClient, pvc, pv)
+
+	if err := ctrl.syncPVC(testNamespace + "/" + testPVCName); err != nil {
+		t.Fatalf("syncPVC failed: %v", err)
+	}
+
+	if len(csiClient.expandCalls) != 1 {
+		t.Fatalf("expected exactly one Expand call, got %d", len(csiClient.expandCalls))
+	}
+	// pvc.Spec.VolumeName (testPVName) is the PV object's name, not the CSI
+	// volume handle; Expand must have been called with the latter.
+	if got := csiClient.expandCalls[0].volumeID; got != testVolumeID {
+		t.Errorf("expected Expand to be called with the PV's CSI volume handle %q, got %q", testVolumeID, got)
+	}
+
+	capability := csiClient.expandCalls[0].capability
+	if capability == nil {
+		t.Fatal("expected Expand to be called with a non-nil VolumeCapability derived from the bound PV")
+	}
+	if capability.AccessMode.Mode != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
+		t.Errorf("expected a ReadWriteOnce PV to map to SINGLE_NODE_WRITER, got %v", capability.AccessMode.Mode)
+	}
+}
+
+func TestSyncPVCPersistsCapacityAndCondition(t *testing.T) {
+	pvc := testPVC("2Gi", "1Gi")
+	pv := testPV()
+	newCapacity := int64(2 * 1024 * 1024 * 1024)
+	csiClient := &fakeCSIConnection{supportsExpand: true, newCapacity: newCapacity, nodeExpansionRequired: true}
+	ctrl, kubeClient := newTestController(csiClient, pvc, pv)
+
+	if err := ctrl.syncPVC(testNamespace + "/" + testPVCName); err != nil {
+		t.Fatalf("syncPVC failed: %v", err)
+	}
+
+	updated, err := kubeClient.CoreV1().PersistentVolumeClaims(testNamespace).Get(testPVCName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get updated PVC: %v", err)
+	}
+
+	gotCapacity := updated.Status.Capacity[v1.ResourceStorage]
+	if gotCapacity.Value() != newCapacity {
+		t.Errorf("expected persisted capacity %d, got %d", newCapacity, gotCapacity.Value())
+	}
+
+	found := false
+	for _, cond := range updated.Status.Conditions {
+		if cond.Type == v1.PersistentVolumeClaimFileSystemResizePending && cond.Status == v1.ConditionTrue {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected a FileSystemResizePending condition to be set, got %+v", updated.Status.Conditions)
+	}
+
+	// A subsequent resync must see the persisted capacity and stop
+	// resizing, instead of calling Expand again forever.
+	if err := ctrl.syncPVC(testNamespace + "/" + testPVCName); err != nil {
+		t.Fatalf("second syncPVC failed: %v", err)
+	}
+	if len(csiClient.expandCalls) != 1 {
+		t.Errorf("expected Expand to be called once total, got %d calls: the resize loop did not converge", len(csiClient.expandCalls))
+	}
+}
+
+func TestSyncPVCFinalErrorEventOnlyNoRetryLoop(t *testing.T) {
+	pvc := testPVC("2Gi", "1Gi")
+	pv := testPV()
+	csiClient := &fakeCSIConnection{supportsExpand: true, expandErr: fmt.Errorf("volume not found")}
+	ctrl, kubeClient := newTestController(csiClient, pvc, pv)
+
+	err := ctrl.syncPVC(testNamespace + "/" + testPVCName)
+	if err != nil {
+		t.Fatalf("expected a final error to be swallowed (reported via event, not requeue), got: %v", err)
+	}
+
+	updated, err := kubeClient.CoreV1().PersistentVolumeClaims(testNamespace).Get(testPVCName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get PVC: %v", err)
+	}
+	if _, ok := updated.Status.Capacity[v1.ResourceStorage]; ok {
+		if updated.Status.Capacity[v1.ResourceStorage].Value() != resource.MustParse("1Gi").Value() {
+			t.Errorf("status capacity should be unchanged after a failed expand, got %v", updated.Status.Capacity)
+		}
+	}
+
+	if len(csiClient.expandCalls) != 1 {
+		t.Errorf("expected exactly one Expand attempt for a final error, got %d", len(csiClient.expandCalls))
+	}
+}
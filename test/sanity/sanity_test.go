@@ -0,0 +1,252 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sanity exercises connection.CSIConnection against a real gRPC
+// stack over a unix socket, rather than the gomock expectations used by
+// pkg/connection's unit tests. By default it boots an embedded
+// kubernetes-csi/csi-test mock driver; passing -csi.endpoint (and
+// optionally -csi.controllerendpoint) instead points the same tests at an
+// out-of-tree driver, so this suite can run in CI against a real
+// implementation.
+package sanity
+
+import (
+	"context"
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/kubernetes-csi/csi-test/driver"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/kubernetes-csi/external-attacher/pkg/connection"
+)
+
+var (
+	csiEndpoint = flag.String("csi.endpoint", "",
+		"address of a running CSI driver's socket to test against. If empty, an embedded mock driver is started for the duration of the test.")
+	csiControllerEndpoint = flag.String("csi.controllerendpoint", "",
+		"address of a separate controller-only CSI socket, for drivers split per NewSplit. Defaults to -csi.endpoint.")
+)
+
+// sanityHarness wires a connection.CSIConnection up either against
+// -csi.endpoint or against an embedded mock driver, so the tests below can
+// run unmodified in both modes.
+type sanityHarness struct {
+	conn connection.CSIConnection
+
+	// Only set when running against the embedded mock driver.
+	mockController   *gomock.Controller
+	driver           *driver.MockCSIDriver
+	identityServer   *driver.MockIdentityServer
+	controllerServer *driver.MockControllerServer
+	nodeServer       *driver.MockNodeServer
+}
+
+func newSanityHarness(t *testing.T) *sanityHarness {
+	if *csiEndpoint != "" {
+		controllerEndpoint := *csiControllerEndpoint
+		if controllerEndpoint == "" {
+			controllerEndpoint = *csiEndpoint
+		}
+		conn, err := connection.NewSplit(controllerEndpoint, *csiEndpoint, 10)
+		if err != nil {
+			t.Fatalf("failed to dial %s / %s: %v", controllerEndpoint, *csiEndpoint, err)
+		}
+		return &sanityHarness{conn: conn}
+	}
+
+	mockController := gomock.NewController(t)
+	identityServer := driver.NewMockIdentityServer(mockController)
+	controllerServer := driver.NewMockControllerServer(mockController)
+	nodeServer := driver.NewMockNodeServer(mockController)
+	drv := driver.NewMockCSIDriver(&driver.MockCSIDriverServers{
+		Identity:   identityServer,
+		Controller: controllerServer,
+		Node:       nodeServer,
+	})
+	drv.Start()
+
+	conn, err := connection.New(drv.Address(), 10, connection.WithRetryPolicy(connection.RetryPolicy{
+		MaxAttempts:       5,
+		InitialBackoff:    5 * time.Millisecond,
+		MaxBackoff:        50 * time.Millisecond,
+		BackoffMultiplier: 2,
+	}))
+	if err != nil {
+		drv.Stop()
+		mockController.Finish()
+		t.Fatalf("failed to dial embedded mock driver: %v", err)
+	}
+
+	return &sanityHarness{
+		conn:             conn,
+		mockController:   mockController,
+		driver:           drv,
+		identityServer:   identityServer,
+		controllerServer: controllerServer,
+		nodeServer:       nodeServer,
+	}
+}
+
+func (h *sanityHarness) embedded() bool {
+	return h.driver != nil
+}
+
+func (h *sanityHarness) Close() {
+	h.conn.Close()
+	if h.driver != nil {
+		h.driver.Stop()
+	}
+	if h.mockController != nil {
+		h.mockController.Finish()
+	}
+}
+
+func defaultCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		},
+	}
+}
+
+func TestGetDriverName(t *testing.T) {
+	h := newSanityHarness(t)
+	defer h.Close()
+
+	if h.embedded() {
+		h.identityServer.EXPECT().GetPluginInfo(gomock.Any(), gomock.Any()).
+			Return(&csi.GetPluginInfoResponse{Name: "csi-sanity.example.com"}, nil).AnyTimes()
+	}
+
+	name, err := h.conn.GetDriverName(context.Background())
+	if err != nil {
+		t.Fatalf("GetDriverName failed: %v", err)
+	}
+	if name == "" {
+		t.Error("expected a non-empty driver name")
+	}
+}
+
+func TestSupportsControllerPublish(t *testing.T) {
+	h := newSanityHarness(t)
+	defer h.Close()
+
+	if h.embedded() {
+		h.controllerServer.EXPECT().ControllerGetCapabilities(gomock.Any(), gomock.Any()).
+			Return(&csi.ControllerGetCapabilitiesResponse{
+				Capabilities: []*csi.ControllerServiceCapability{
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{
+								Type: csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+							},
+						},
+					},
+				},
+			}, nil).AnyTimes()
+	}
+
+	if _, err := h.conn.SupportsControllerPublish(context.Background()); err != nil {
+		t.Fatalf("SupportsControllerPublish failed: %v", err)
+	}
+}
+
+func TestAttachDetach(t *testing.T) {
+	h := newSanityHarness(t)
+	defer h.Close()
+
+	volumeID := "sanity-volume"
+	nodeID := "sanity-node"
+
+	if h.embedded() {
+		h.controllerServer.EXPECT().ControllerPublishVolume(gomock.Any(), gomock.Any()).
+			Return(&csi.ControllerPublishVolumeResponse{}, nil).Times(1)
+		h.controllerServer.EXPECT().ControllerUnpublishVolume(gomock.Any(), gomock.Any()).
+			Return(&csi.ControllerUnpublishVolumeResponse{}, nil).Times(1)
+	}
+
+	if _, detached, err := h.conn.Attach(context.Background(), volumeID, false, nodeID, defaultCapability()); err != nil || detached {
+		t.Fatalf("Attach failed: detached=%v err=%v", detached, err)
+	}
+
+	if detached, err := h.conn.Detach(context.Background(), volumeID, nodeID); err != nil || !detached {
+		t.Fatalf("Detach failed: detached=%v err=%v", detached, err)
+	}
+}
+
+// TestAttachSurvivesAborted proves that a CSI driver reporting Aborted
+// (an operation is already pending for the volume) does not fail the
+// attacher outright: Attach's retry loop should ride it out and succeed
+// once the driver is free to process the request.
+func TestAttachSurvivesAborted(t *testing.T) {
+	h := newSanityHarness(t)
+	defer h.Close()
+	if !h.embedded() {
+		t.Skip("this negative-path scenario requires the embedded mock driver")
+	}
+
+	gomock.InOrder(
+		h.controllerServer.EXPECT().ControllerPublishVolume(gomock.Any(), gomock.Any()).
+			Return(nil, status.Error(codes.Aborted, "operation already pending for volume")).Times(1),
+		h.controllerServer.EXPECT().ControllerPublishVolume(gomock.Any(), gomock.Any()).
+			Return(&csi.ControllerPublishVolumeResponse{}, nil).Times(1),
+	)
+
+	_, detached, err := h.conn.Attach(context.Background(), "sanity-volume", false, "sanity-node", defaultCapability())
+	if err != nil || detached {
+		t.Fatalf("expected Attach to recover from a transient Aborted error, got detached=%v err=%v", detached, err)
+	}
+}
+
+// TestAttachSocketKilledMidCall kills the driver's socket before Attach
+// gets a response and checks that the resulting Unavailable error is
+// classified as transient (not detached), matching how a real driver
+// restart should be handled.
+func TestAttachSocketKilledMidCall(t *testing.T) {
+	h := newSanityHarness(t)
+	defer h.Close()
+	if !h.embedded() {
+		t.Skip("this negative-path scenario requires the embedded mock driver")
+	}
+
+	conn, err := connection.New(h.driver.Address(), 10, connection.WithRetryPolicy(connection.RetryPolicy{MaxAttempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	h.driver.Stop()
+	h.driver = nil // already stopped; don't stop it again in h.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, detached, err := conn.Attach(ctx, "sanity-volume", false, "sanity-node", defaultCapability())
+	if err == nil {
+		t.Fatal("expected an error after killing the driver socket, got none")
+	}
+	if detached {
+		t.Errorf("expected a killed socket to be classified as a transient error (detached=false), got detached=true, err=%v", err)
+	}
+}